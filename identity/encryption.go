@@ -0,0 +1,157 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Parameters for the scrypt KDF used to derive the AES-GCM key from the
+// user-supplied passphrase. N, R, P and the salt length are only used
+// for newly encrypted private keys; the N, R, P and salt actually used to
+// decrypt a given key are read back from its envelope. scryptKeyLen is
+// not stored in the envelope and is used for both.
+const (
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+// encryptedKeyVersion identifies the envelope format below, so that it
+// can evolve (e.g. a different KDF or cipher) without breaking the
+// ability to decrypt keys saved by older versions.
+const encryptedKeyVersion = 1
+
+// encryptedKeyEnvelope is the versioned, self-contained representation
+// of an encrypted private key. It is marshaled to JSON and then
+// base64-encoded to become the value of identityJSON.EncryptedPrivateKey.
+type encryptedKeyEnvelope struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       string `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// encryptPrivateKey marshals priv and seals it with a key derived from
+// passphrase via scrypt, returning the envelope encoded as a string
+// suitable for identityJSON.EncryptedPrivateKey.
+func encryptPrivateKey(priv crypto.PrivKey, passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", fmt.Errorf("cannot encrypt private key with an empty passphrase")
+	}
+
+	pkb, err := priv.Bytes()
+	if err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, pkb, nil)
+
+	envelope := encryptedKeyEnvelope{
+		Version:    encryptedKeyVersion,
+		KDF:        "scrypt",
+		Salt:       hex.EncodeToString(salt),
+		N:          scryptN,
+		R:          scryptR,
+		P:          scryptP,
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(ciphertext),
+	}
+
+	raw, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// decryptPrivateKey reverses encryptPrivateKey, returning the marshaled
+// private key bytes so that the caller can crypto.UnmarshalPrivateKey
+// them.
+func decryptPrivateKey(encoded string, passphrase string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding encrypted_private_key: %s", err)
+	}
+
+	envelope := &encryptedKeyEnvelope{}
+	if err := json.Unmarshal(raw, envelope); err != nil {
+		return nil, fmt.Errorf("error unmarshaling encrypted_private_key envelope: %s", err)
+	}
+
+	if envelope.Version != encryptedKeyVersion || envelope.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported encrypted private key envelope (version %d, kdf %q)", envelope.Version, envelope.KDF)
+	}
+
+	salt, err := hex.DecodeString(envelope.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding salt: %s", err)
+	}
+	nonce, err := hex.DecodeString(envelope.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding nonce: %s", err)
+	}
+	ciphertext, err := hex.DecodeString(envelope.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ciphertext: %s", err)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, envelope.N, envelope.R, envelope.P, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	pkb, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting private key: wrong passphrase or corrupted data")
+	}
+
+	return pkb, nil
+}
@@ -0,0 +1,45 @@
+package identity
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSaveJSONEncryptedLoadJSONEncrypted(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+
+	tmpDir, err := ioutil.TempDir("", "identity-encryption-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := tmpDir + "/identity.json"
+
+	if err := id.SaveJSONEncrypted(path, "correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id2 := &Identity{}
+	if err := id2.LoadJSONEncrypted(raw, "correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if !id2.PrivateKey.Equals(id.PrivateKey) {
+		t.Error("PrivateKey did not round-trip through encryption")
+	}
+
+	id3 := &Identity{}
+	if err := id3.LoadJSONEncrypted(raw, "wrong passphrase"); err == nil {
+		t.Error("expected an error when loading with the wrong passphrase")
+	}
+
+	id4 := &Identity{}
+	if err := id4.LoadJSON(raw); err == nil {
+		t.Error("expected LoadJSON to fail on an encrypted identity with no passphrase available")
+	}
+}
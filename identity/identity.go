@@ -1,6 +1,7 @@
 package identity
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -25,6 +26,10 @@ const (
 	DefaultConfigKeyLength = 2048
 )
 
+// envPrivateKeyPassphrase is the environment variable read to decrypt an
+// encrypted private key when no passphrase is otherwise supplied.
+const envPrivateKeyPassphrase = "CLUSTER_PRIVATEKEY_PASSPHRASE"
+
 // Identity contains information about identity of a peer
 type Identity struct {
 	// Libp2p ID and private key for Cluster communication (including)
@@ -32,6 +37,11 @@ type Identity struct {
 	ID         peer.ID
 	PrivateKey crypto.PrivKey
 
+	// KeySource records where PrivateKey was loaded from. Saving the
+	// identity back out preserves it, rather than always inlining
+	// PrivateKey's bytes into the identity file. See KeySourceConfig.
+	KeySource KeySourceConfig
+
 	// User-defined peername for use as human-readable identifier.
 	Peername string
 
@@ -39,31 +49,91 @@ type Identity struct {
 	// only if they have the same ClusterSecret. The cluster secret must be exactly
 	// 64 characters and contain only hexadecimal characters (`[0-9a-f]`).
 	Secret []byte
+
+	// SecretsPrevious holds cluster secrets retired by RotateSecret,
+	// most recent first. They are no longer used for new connections
+	// but are still accepted from peers during the pnet handshake,
+	// allowing a secret to be rotated across a cluster without having
+	// to restart every peer at once. See AcceptedSecrets.
+	SecretsPrevious [][]byte
 }
 
+// maxPreviousSecrets bounds how many retired cluster secrets
+// RotateSecret keeps around for AcceptedSecrets.
+const maxPreviousSecrets = 3
+
 // identityJSON represents a Identity as it will look when it is
 // saved using JSON. Most keys are converted into simple types
 // like strings, and key names aim to be self-explanatory for the user.
 type identityJSON struct {
-	ID         string `json:"id"`
-	Peername   string `json:"peername"`
-	PrivateKey string `json:"private_key"`
-	Secret     string `json:"secret"`
+	ID                  string `json:"id"`
+	Peername            string `json:"peername"`
+	PrivateKey          string `json:"private_key,omitempty"`
+	EncryptedPrivateKey string `json:"encrypted_private_key,omitempty"`
+	Secret              string `json:"secret"`
+
+	// PrivateKeySource selects where the private key is actually read
+	// from. It is one of "inline" (the default, PrivateKey/
+	// EncryptedPrivateKey above), "file", "env" or "exec". Secret is
+	// always read from this JSON regardless of the source. ID, when set
+	// here, must match the ID derived from the loaded private key; when
+	// empty, the derived ID is used.
+	PrivateKeySource string `json:"private_key_source,omitempty"`
+	// PrivateKeyPath is the node_key.json-style file to load the
+	// private key from when PrivateKeySource is "file".
+	PrivateKeyPath string `json:"private_key_path,omitempty"`
+	// PrivateKeyEnvVar is the environment variable to read the
+	// marshaled private key from when PrivateKeySource is "env".
+	PrivateKeyEnvVar string `json:"private_key_env_var,omitempty"`
+	// PrivateKeyExec is the external command run to obtain the
+	// marshaled private key when PrivateKeySource is "exec".
+	PrivateKeyExec string `json:"private_key_exec,omitempty"`
+
+	// KeyType records the algorithm of PrivateKey ("rsa", "ed25519" or
+	// "secp256k1"), so that applyConfigJSON can confirm the decoded key
+	// is actually of the expected type. It is informational only when
+	// not set, for compatibility with identities saved before this
+	// field existed.
+	KeyType string `json:"key_type,omitempty"`
+
+	// PreviousSecrets holds hex-encoded cluster secrets retired by
+	// RotateSecret, most recent first. See Identity.SecretsPrevious.
+	PreviousSecrets []string `json:"previous_secrets,omitempty"`
 }
 
-// Default will generate a valid random ID, PrivateKey and
-// Secret.
-func (id *Identity) Default() error {
+// IdentityOptions customizes the key generated by Identity.Default. The
+// zero value generates an RSA-2048 key, matching the historical,
+// pre-IdentityOptions behavior of Default.
+type IdentityOptions struct {
+	// KeyType is one of crypto.RSA, crypto.Ed25519 or
+	// crypto.Secp256k1. The zero value is crypto.RSA.
+	KeyType int
+	// KeyBits is the key length in bits. It only applies to KeyType
+	// crypto.RSA; Ed25519 and Secp256k1 keys have a fixed size and
+	// ignore it. The zero value is DefaultConfigKeyLength.
+	KeyBits int
+}
+
+// Default will generate a valid random ID, PrivateKey and Secret. With
+// no options (or the zero value), it generates an RSA-2048 key, as it
+// always has; pass an IdentityOptions to opt into Ed25519 or
+// Secp256k1 instead.
+func (id *Identity) Default(opts IdentityOptions) error {
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = ""
 	}
 	id.Peername = hostname
 
+	keyBits := opts.KeyBits
+	if keyBits == 0 {
+		keyBits = DefaultConfigKeyLength
+	}
+
 	// pid and private key generation --
 	priv, pub, err := crypto.GenerateKeyPair(
-		DefaultConfigCrypto,
-		DefaultConfigKeyLength)
+		opts.KeyType,
+		keyBits)
 	if err != nil {
 		return err
 	}
@@ -87,7 +157,10 @@ func (id *Identity) Default() error {
 
 // LoadJSON receives a raw json-formatted identity and
 // sets the Config fields from it. Note that it should be JSON
-// as generated by ToJSON().
+// as generated by ToJSON(). If the identity was saved with
+// SaveJSONEncrypted, LoadJSON decrypts it only with the passphrase found
+// in the CLUSTER_PRIVATEKEY_PASSPHRASE environment variable; use
+// LoadJSONEncrypted to pass the passphrase directly.
 func (id *Identity) LoadJSON(raw []byte) error {
 	jID := &identityJSON{}
 	err := json.Unmarshal(raw, jID)
@@ -102,41 +175,100 @@ func (id *Identity) LoadJSON(raw []byte) error {
 	}
 	id.Peername = hostname
 
-	return id.applyConfigJSON(jID)
+	return id.applyConfigJSON(jID, os.Getenv(envPrivateKeyPassphrase))
 }
 
-func (id *Identity) applyConfigJSON(jID *identityJSON) error {
-	pid, err := peer.IDB58Decode(jID.ID)
+// LoadJSONEncrypted receives a raw json-formatted identity, as generated
+// by SaveJSONEncrypted, and sets the Config fields from it, decrypting
+// the private key with the given passphrase. If the private key was not
+// actually encrypted, passphrase is ignored and LoadJSONEncrypted behaves
+// like LoadJSON.
+func (id *Identity) LoadJSONEncrypted(raw []byte, passphrase string) error {
+	jID := &identityJSON{}
+	err := json.Unmarshal(raw, jID)
 	if err != nil {
-		err = fmt.Errorf("error decoding cluster ID: %s", err)
+		logger.Error("Error unmarshaling cluster config")
 		return err
 	}
-	id.ID = pid
 
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+	id.Peername = hostname
+
+	return id.applyConfigJSON(jID, passphrase)
+}
+
+func (id *Identity) applyConfigJSON(jID *identityJSON, passphrase string) error {
 	config.SetIfNotDefault(jID.Peername, &id.Peername)
 
-	pkb, err := base64.StdEncoding.DecodeString(jID.PrivateKey)
+	provider, err := newKeyProvider(jID, passphrase)
 	if err != nil {
-		err = fmt.Errorf("error decoding private_key: %s", err)
 		return err
 	}
-	pKey, err := crypto.UnmarshalPrivateKey(pkb)
+
+	pKey, err := provider.PrivateKey()
 	if err != nil {
-		err = fmt.Errorf("error parsing private_key ID: %s", err)
-		return err
+		return fmt.Errorf("error loading private_key: %s", err)
+	}
+	if jID.KeyType != "" {
+		gotType, err := keyTypeName(pKey)
+		if err != nil {
+			return err
+		}
+		if gotType != jID.KeyType {
+			return fmt.Errorf("key_type is %q but the loaded private key is %q", jID.KeyType, gotType)
+		}
 	}
 	id.PrivateKey = pKey
+	id.KeySource = KeySourceConfig{
+		Source: jID.PrivateKeySource,
+		Path:   jID.PrivateKeyPath,
+		EnvVar: jID.PrivateKeyEnvVar,
+		Exec:   jID.PrivateKeyExec,
+	}
+
+	pid, err := identityIDFromJSON(jID, pKey)
+	if err != nil {
+		return err
+	}
+	id.ID = pid
 
-	clusterSecret, err := DecodeClusterSecret(jID.Secret)
+	clusterSecrets, err := DecodeClusterSecret(append([]string{jID.Secret}, jID.PreviousSecrets...)...)
 	if err != nil {
 		err = fmt.Errorf("error loading cluster secret from config: %s", err)
 		return err
 	}
-	id.Secret = clusterSecret
+	id.Secret = clusterSecrets[0]
+	id.SecretsPrevious = clusterSecrets[1:]
 
 	return id.Validate()
 }
 
+// identityIDFromJSON decodes jID.ID when present and checks that it
+// matches the peer ID derived from priv's public half. When jID.ID is
+// empty, the derived ID is used directly.
+func identityIDFromJSON(jID *identityJSON, priv crypto.PrivKey) (peer.ID, error) {
+	derived, err := peer.IDFromPublicKey(priv.GetPublic())
+	if err != nil {
+		return "", fmt.Errorf("error deriving cluster ID from private key: %s", err)
+	}
+
+	if jID.ID == "" {
+		return derived, nil
+	}
+
+	pid, err := peer.IDB58Decode(jID.ID)
+	if err != nil {
+		return "", fmt.Errorf("error decoding cluster ID: %s", err)
+	}
+	if pid != derived {
+		return "", errors.New("cluster ID does not match the loaded private key")
+	}
+	return pid, nil
+}
+
 // Validate will check that the values of this identity
 // seem to be working ones.
 func (id *Identity) Validate() error {
@@ -148,6 +280,12 @@ func (id *Identity) Validate() error {
 		return errors.New("no cluster.private_key set")
 	}
 
+	for _, s := range id.SecretsPrevious {
+		if len(s) > 0 && bytes.Equal(s, id.Secret) {
+			return errors.New("cluster.previous_secrets contains the current cluster.secret")
+		}
+	}
+
 	return nil
 }
 
@@ -172,38 +310,170 @@ func (id *Identity) toIdentityJSON() (jID *identityJSON, err error) {
 
 	jID = &identityJSON{}
 
-	// Private Key
-	pkeyBytes, err := id.PrivateKey.Bytes()
+	keyType, err := keyTypeName(id.PrivateKey)
 	if err != nil {
 		return
 	}
-	pKey := base64.StdEncoding.EncodeToString(pkeyBytes)
+
+	// Private Key: preserve whatever source it was loaded from. A
+	// non-inline source (file/env/exec) keeps the actual key bytes out
+	// of this JSON entirely; only "inline" (the zero value, for
+	// backwards compatibility) writes PrivateKey out directly.
+	switch id.KeySource.Source {
+	case "", PrivateKeySourceInline:
+		pkeyBytes, perr := id.PrivateKey.Bytes()
+		if perr != nil {
+			err = perr
+			return
+		}
+		jID.PrivateKey = base64.StdEncoding.EncodeToString(pkeyBytes)
+	case PrivateKeySourceFile:
+		jID.PrivateKeySource = PrivateKeySourceFile
+		jID.PrivateKeyPath = id.KeySource.Path
+	case PrivateKeySourceEnv:
+		jID.PrivateKeySource = PrivateKeySourceEnv
+		jID.PrivateKeyEnvVar = id.KeySource.EnvVar
+	case PrivateKeySourceExec:
+		jID.PrivateKeySource = PrivateKeySourceExec
+		jID.PrivateKeyExec = id.KeySource.Exec
+	default:
+		err = fmt.Errorf("unknown private key source: %q", id.KeySource.Source)
+		return
+	}
 
 	// Set all identity fields
 	jID.ID = id.ID.Pretty()
 	jID.Peername = id.Peername
-	jID.PrivateKey = pKey
+	jID.KeyType = keyType
 	jID.Secret = EncodeProtectorKey(id.Secret)
 
+	previousSecrets := make([]string, len(id.SecretsPrevious))
+	for i, s := range id.SecretsPrevious {
+		previousSecrets[i] = EncodeProtectorKey(s)
+	}
+	jID.PreviousSecrets = previousSecrets
+
 	return
 }
 
-// DecodeClusterSecret parses a hex-encoded string, checks that it is exactly
-// 32 bytes long and returns its value as a byte-slice.x
-func DecodeClusterSecret(hexSecret string) ([]byte, error) {
-	secret, err := hex.DecodeString(hexSecret)
+// Rotate generates a fresh private key of newKeyType, replacing the
+// current ID and PrivateKey, and returns the previous peer ID so that
+// callers can update the cluster peerstore (and any other place the old
+// ID was advertised) accordingly. It does not touch Secret or Peername.
+//
+// The new key is always made the inline one (KeySource is reset to its
+// zero value), since Rotate has no way to write it into whatever
+// external file/env/exec provider the old key came from. Without this,
+// a subsequent SaveJSON/SaveJSONEncrypted would write the new ID
+// alongside a stale reference to the old provider, which would then
+// hand back the old key on the next LoadJSON and fail identityIDFromJSON's
+// ID/key match check.
+func (id *Identity) Rotate(newKeyType int) (peer.ID, error) {
+	oldID := id.ID
+
+	priv, pub, err := crypto.GenerateKeyPair(newKeyType, DefaultConfigKeyLength)
 	if err != nil {
-		return nil, err
-	}
-	switch secretLen := len(secret); secretLen {
-	case 0:
-		logger.Warning("Cluster secret is empty, cluster will start on unprotected network.")
-		return nil, nil
-	case 32:
-		return secret, nil
+		return oldID, err
+	}
+	pid, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return oldID, err
+	}
+
+	id.PrivateKey = priv
+	id.ID = pid
+	id.KeySource = KeySourceConfig{}
+
+	return oldID, nil
+}
+
+// keyTypeName returns the short, stable name used in identityJSON.KeyType
+// for the algorithm behind priv.
+func keyTypeName(priv crypto.PrivKey) (string, error) {
+	switch priv.(type) {
+	case *crypto.RsaPrivateKey:
+		return "rsa", nil
+	case *crypto.Ed25519PrivateKey:
+		return "ed25519", nil
+	case *crypto.Secp256k1PrivateKey:
+		return "secp256k1", nil
 	default:
-		return nil, fmt.Errorf("input secret is %d bytes, cluster secret should be 32", secretLen)
+		return "", fmt.Errorf("unsupported private key type %T", priv)
+	}
+}
+
+// DecodeClusterSecret parses one or more hex-encoded strings, checking
+// that each is exactly 32 bytes long, and returns their values as
+// byte-slices in the same order. It is typically called with the active
+// secret followed by any previous secrets, as found in an identityJSON.
+func DecodeClusterSecret(hexSecrets ...string) ([][]byte, error) {
+	secrets := make([][]byte, 0, len(hexSecrets))
+	for _, hexSecret := range hexSecrets {
+		secret, err := hex.DecodeString(hexSecret)
+		if err != nil {
+			return nil, err
+		}
+		switch secretLen := len(secret); secretLen {
+		case 0:
+			logger.Warning("Cluster secret is empty, cluster will start on unprotected network.")
+			secrets = append(secrets, nil)
+		case 32:
+			secrets = append(secrets, secret)
+		default:
+			return nil, fmt.Errorf("input secret is %d bytes, cluster secret should be 32", secretLen)
+		}
+	}
+	return secrets, nil
+}
+
+// AcceptedSecrets returns every cluster secret this identity currently
+// accepts during the pnet handshake: the active Secret, followed by any
+// retired secrets in SecretsPrevious. The protector should try each of
+// these in turn, rather than only Secret, so that peers are not locked
+// out mid-rotation.
+func (id *Identity) AcceptedSecrets() [][]byte {
+	secrets := make([][]byte, 0, 1+len(id.SecretsPrevious))
+	secrets = append(secrets, id.Secret)
+	secrets = append(secrets, id.SecretsPrevious...)
+	return secrets
+}
+
+// RotateSecret retires the current Secret into SecretsPrevious (keeping
+// at most maxPreviousSecrets of them), generates a fresh one, and
+// re-saves the identity to path so that the rotation survives a
+// restart. Peers can then be updated one at a time: until they all have
+// the new secret, AcceptedSecrets lets them keep talking to each other
+// using whichever of the last few secrets they were started with.
+//
+// The private key is never touched: an external file/env/exec
+// KeySource is preserved as-is when path is re-saved. passphrase is only
+// consulted, and only re-applied via SaveJSONEncrypted, when the private
+// key is inline. With an empty passphrase an inline key is saved in
+// plaintext via SaveJSON, even if it was loaded from an encrypted
+// identity.
+func (id *Identity) RotateSecret(path string, passphrase string) error {
+	newSecret, err := pnet.GenerateV1Bytes()
+	if err != nil {
+		return err
 	}
+
+	// An empty current Secret means the cluster is running
+	// unprotected; it is not a retired secret worth accepting later.
+	if len(id.Secret) > 0 {
+		id.SecretsPrevious = append([][]byte{id.Secret}, id.SecretsPrevious...)
+		if len(id.SecretsPrevious) > maxPreviousSecrets {
+			id.SecretsPrevious = id.SecretsPrevious[:maxPreviousSecrets]
+		}
+	}
+	id.Secret = (*newSecret)[:]
+
+	// Only an inline private key can be re-encrypted on save; a key
+	// coming from a file/env/exec provider is left to that provider,
+	// and SaveJSON already preserves id.KeySource when writing path.
+	if passphrase != "" && (id.KeySource.Source == "" || id.KeySource.Source == PrivateKeySourceInline) {
+		return id.SaveJSONEncrypted(path, passphrase)
+	}
+	return id.SaveJSON(path)
 }
 
 // EncodeProtectorKey converts a byte slice to its hex string representation.
@@ -279,7 +549,7 @@ func (id *Identity) ApplyEnvVars() error {
 		return err
 	}
 
-	return id.applyConfigJSON(jID)
+	return id.applyConfigJSON(jID, os.Getenv(envPrivateKeyPassphrase))
 }
 
 // SaveJSON saves the JSON representation of the Identity to
@@ -294,3 +564,36 @@ func (id *Identity) SaveJSON(path string) error {
 
 	return ioutil.WriteFile(path, bs, 0600)
 }
+
+// SaveJSONEncrypted saves the JSON representation of the Identity to the
+// given path, encrypting the private key with passphrase. The rest of
+// the identity (ID, Peername, Secret) is stored in the clear, same as
+// with SaveJSON. Only identities whose private key is stored inline can
+// be encrypted this way: a key already kept out of the identity file
+// (file/env/exec source) must stay managed by its provider.
+func (id *Identity) SaveJSONEncrypted(path string, passphrase string) error {
+	if id.KeySource.Source != "" && id.KeySource.Source != PrivateKeySourceInline {
+		return fmt.Errorf("cannot encrypt a private key loaded from a %q source; it is already managed outside the identity file", id.KeySource.Source)
+	}
+
+	logger.Info("Saving configuration")
+
+	jID, err := id.toIdentityJSON()
+	if err != nil {
+		return err
+	}
+
+	envelope, err := encryptPrivateKey(id.PrivateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	jID.PrivateKey = ""
+	jID.EncryptedPrivateKey = envelope
+
+	bs, err := json.MarshalIndent(jID, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, bs, 0600)
+}
@@ -0,0 +1,156 @@
+package identity
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+)
+
+func testIdentity(t *testing.T, opts IdentityOptions) *Identity {
+	t.Helper()
+	id := &Identity{}
+	if err := id.Default(opts); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestIdentityToJSONLoadJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		opts IdentityOptions
+	}{
+		{"rsa", IdentityOptions{}},
+		{"ed25519", IdentityOptions{KeyType: crypto.Ed25519}},
+		{"secp256k1", IdentityOptions{KeyType: crypto.Secp256k1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := testIdentity(t, tt.opts)
+
+			raw, err := id.ToJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id2 := &Identity{}
+			if err := id2.LoadJSON(raw); err != nil {
+				t.Fatal(err)
+			}
+
+			if id2.ID != id.ID {
+				t.Errorf("ID did not round-trip: got %s, want %s", id2.ID, id.ID)
+			}
+			if !id2.PrivateKey.Equals(id.PrivateKey) {
+				t.Error("PrivateKey did not round-trip")
+			}
+			if string(id2.Secret) != string(id.Secret) {
+				t.Error("Secret did not round-trip")
+			}
+		})
+	}
+}
+
+func TestIdentityApplyEnvVars(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+
+	os.Setenv("CLUSTER_PEERNAME", "env-peername")
+	defer os.Unsetenv("CLUSTER_PEERNAME")
+
+	if err := id.ApplyEnvVars(); err != nil {
+		t.Fatal(err)
+	}
+
+	if id.Peername != "env-peername" {
+		t.Errorf("expected peername to be overridden by env var, got %q", id.Peername)
+	}
+}
+
+func TestIdentityRotate(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+	oldID := id.ID
+	oldKey := id.PrivateKey
+
+	returnedID, err := id.Rotate(crypto.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if returnedID != oldID {
+		t.Errorf("Rotate returned %s, expected the previous ID %s", returnedID, oldID)
+	}
+	if id.ID == oldID {
+		t.Error("Rotate did not change the ID")
+	}
+	if id.PrivateKey.Equals(oldKey) {
+		t.Error("Rotate did not change the PrivateKey")
+	}
+	if keyType, err := keyTypeName(id.PrivateKey); err != nil || keyType != "ed25519" {
+		t.Errorf("expected Rotate to generate an ed25519 key, got %q (err %v)", keyType, err)
+	}
+
+	// Rotate must round-trip through ToJSON/LoadJSON like Default does.
+	raw, err := id.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2 := &Identity{}
+	if err := id2.LoadJSON(raw); err != nil {
+		t.Fatal(err)
+	}
+	if id2.ID != id.ID || !id2.PrivateKey.Equals(id.PrivateKey) {
+		t.Error("rotated identity did not round-trip through ToJSON/LoadJSON")
+	}
+}
+
+func TestIdentityRotateAndAcceptedSecrets(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+
+	tmpDir, err := ioutil.TempDir("", "identity-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := tmpDir + "/identity.json"
+
+	if err := id.SaveJSON(path); err != nil {
+		t.Fatal(err)
+	}
+
+	original := id.Secret
+
+	if err := id.RotateSecret(path, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(id.Secret) == string(original) {
+		t.Error("expected Secret to change after RotateSecret")
+	}
+	if len(id.SecretsPrevious) != 1 || string(id.SecretsPrevious[0]) != string(original) {
+		t.Error("expected the old Secret to be retained in SecretsPrevious")
+	}
+
+	accepted := id.AcceptedSecrets()
+	if len(accepted) != 2 {
+		t.Fatalf("expected 2 accepted secrets, got %d", len(accepted))
+	}
+	if string(accepted[0]) != string(id.Secret) || string(accepted[1]) != string(original) {
+		t.Error("AcceptedSecrets did not return the active secret followed by the retired one")
+	}
+
+	// The rotation must have been persisted to disk.
+	id2 := &Identity{}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := id2.LoadJSON(raw); err != nil {
+		t.Fatal(err)
+	}
+	if string(id2.Secret) != string(id.Secret) {
+		t.Error("rotated secret was not saved to path")
+	}
+}
@@ -0,0 +1,219 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+)
+
+// Recognized values of identityJSON.PrivateKeySource.
+const (
+	PrivateKeySourceInline = "inline"
+	PrivateKeySourceFile   = "file"
+	PrivateKeySourceEnv    = "env"
+	PrivateKeySourceExec   = "exec"
+)
+
+// defaultPrivateKeyEnvVar is used by the "env" source when
+// PrivateKeyEnvVar is not set.
+const defaultPrivateKeyEnvVar = "CLUSTER_PRIVATE_KEY"
+
+// KeySourceConfig records where an Identity's PrivateKey was loaded
+// from, so that saving the identity back out (ToJSON, SaveJSON,
+// SaveJSONEncrypted, RotateSecret...) can preserve that source instead
+// of defaulting to inlining the key bytes. The zero value means
+// "inline", matching the original, still-default behavior.
+type KeySourceConfig struct {
+	// Source is one of "", PrivateKeySourceInline, PrivateKeySourceFile,
+	// PrivateKeySourceEnv or PrivateKeySourceExec.
+	Source string
+	// Path is the node_key.json-style file backing a "file" source.
+	Path string
+	// EnvVar is the environment variable backing an "env" source.
+	EnvVar string
+	// Exec is the external command backing an "exec" source.
+	Exec string
+}
+
+// KeyProvider resolves the libp2p private key used by an Identity. It
+// exists so that the private key backing a cluster peer's identity does
+// not have to live in the main cluster configuration file: implementations
+// can instead read it from a dedicated file, an environment variable, or
+// hand it off to an external process that talks to a secrets manager
+// such as Vault, a cloud KMS, or a PKCS#11 HSM.
+type KeyProvider interface {
+	// PrivateKey returns the unmarshaled private key.
+	PrivateKey() (crypto.PrivKey, error)
+}
+
+// newKeyProvider builds the KeyProvider indicated by jID.PrivateKeySource.
+// An empty PrivateKeySource defaults to "inline", keeping existing
+// identity.json files working unmodified.
+func newKeyProvider(jID *identityJSON, passphrase string) (KeyProvider, error) {
+	switch jID.PrivateKeySource {
+	case "", PrivateKeySourceInline:
+		return &inlineKeyProvider{jID: jID, passphrase: passphrase}, nil
+	case PrivateKeySourceFile:
+		if jID.PrivateKeyPath == "" {
+			return nil, errors.New("private_key_source is \"file\" but private_key_path is not set")
+		}
+		return &fileKeyProvider{path: jID.PrivateKeyPath, passphrase: passphrase}, nil
+	case PrivateKeySourceEnv:
+		envVar := jID.PrivateKeyEnvVar
+		if envVar == "" {
+			envVar = defaultPrivateKeyEnvVar
+		}
+		return &envKeyProvider{envVar: envVar}, nil
+	case PrivateKeySourceExec:
+		if jID.PrivateKeyExec == "" {
+			return nil, errors.New("private_key_source is \"exec\" but private_key_exec is not set")
+		}
+		return &execKeyProvider{command: jID.PrivateKeyExec}, nil
+	default:
+		return nil, fmt.Errorf("unknown private_key_source: %q", jID.PrivateKeySource)
+	}
+}
+
+// inlineKeyProvider reads the private key directly from the main
+// identity JSON, as PrivateKey or EncryptedPrivateKey. This is the
+// original, still-default, behavior.
+type inlineKeyProvider struct {
+	jID        *identityJSON
+	passphrase string
+}
+
+func (p *inlineKeyProvider) PrivateKey() (crypto.PrivKey, error) {
+	pkb, err := decodeInlinePrivateKeyBytes(p.jID.PrivateKey, p.jID.EncryptedPrivateKey, p.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPrivateKey(pkb)
+}
+
+// decodeInlinePrivateKeyBytes returns the marshaled private key bytes
+// found inline in an identity JSON, decrypting them with passphrase if
+// they were stored encrypted.
+func decodeInlinePrivateKeyBytes(plaintext, encrypted, passphrase string) ([]byte, error) {
+	if encrypted != "" {
+		if passphrase == "" {
+			return nil, errors.New("private key is encrypted but no passphrase was provided")
+		}
+		pkb, err := decryptPrivateKey(encrypted, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting private_key: %s", err)
+		}
+		return pkb, nil
+	}
+
+	pkb, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding private_key: %s", err)
+	}
+	return pkb, nil
+}
+
+// nodeKeyJSON is the contents of a node_key.json-style file: just the
+// private key, optionally encrypted, kept separate from the rest of the
+// cluster identity so that it can be protected, backed up or rotated
+// independently.
+type nodeKeyJSON struct {
+	PrivateKey          string `json:"private_key,omitempty"`
+	EncryptedPrivateKey string `json:"encrypted_private_key,omitempty"`
+}
+
+// fileKeyProvider reads the private key from a separate file, such as
+// node_key.json, referenced by the main identity JSON's
+// private_key_path.
+type fileKeyProvider struct {
+	path       string
+	passphrase string
+}
+
+func (p *fileKeyProvider) PrivateKey() (crypto.PrivKey, error) {
+	raw, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", p.path, err)
+	}
+
+	nkJSON := &nodeKeyJSON{}
+	if err := json.Unmarshal(raw, nkJSON); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %s", p.path, err)
+	}
+
+	pkb, err := decodeInlinePrivateKeyBytes(nkJSON.PrivateKey, nkJSON.EncryptedPrivateKey, p.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key from %s: %s", p.path, err)
+	}
+
+	return crypto.UnmarshalPrivateKey(pkb)
+}
+
+// envKeyProvider reads the base64-encoded, marshaled private key from
+// an environment variable.
+type envKeyProvider struct {
+	envVar string
+}
+
+func (p *envKeyProvider) PrivateKey() (crypto.PrivKey, error) {
+	val := os.Getenv(p.envVar)
+	if val == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", p.envVar)
+	}
+
+	pkb, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding private key from %s: %s", p.envVar, err)
+	}
+
+	return crypto.UnmarshalPrivateKey(pkb)
+}
+
+// execKeyProviderTimeout bounds how long an "exec" key provider may run
+// before identity loading gives up on it, so that a hanging or
+// misbehaving external command cannot block the cluster indefinitely.
+const execKeyProviderTimeout = 30 * time.Second
+
+// execKeyProvider runs an external command and reads the base64-encoded,
+// marshaled private key from its standard output. This allows operators
+// to fetch the private key from systems like HashiCorp Vault, a PKCS#11
+// HSM or a cloud KMS without it ever touching the cluster configuration.
+//
+// private_key_exec is run with "sh -c", so it is trusted exactly like
+// code: anything able to write private_key_exec into the identity file
+// can already run arbitrary commands as the cluster process's user. The
+// identity file must be protected accordingly (the same filesystem
+// permissions one would give a script or binary), not treated as plain
+// configuration data.
+type execKeyProvider struct {
+	command string
+}
+
+func (p *execKeyProvider) PrivateKey() (crypto.PrivKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execKeyProviderTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.command)
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("private_key_exec command timed out after %s", execKeyProviderTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error running private_key_exec command: %s", err)
+	}
+
+	pkb, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding private key from private_key_exec output: %s", err)
+	}
+
+	return crypto.UnmarshalPrivateKey(pkb)
+}
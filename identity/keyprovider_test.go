@@ -0,0 +1,181 @@
+package identity
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+	pkb, err := id.PrivateKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pKey := base64.StdEncoding.EncodeToString(pkb)
+
+	tmpDir, err := ioutil.TempDir("", "identity-keyprovider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	nodeKeyPath := tmpDir + "/node_key.json"
+
+	if err := ioutil.WriteFile(nodeKeyPath, []byte(`{"private_key":"`+pKey+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jID := &identityJSON{
+		Peername:         "filetest",
+		Secret:           EncodeProtectorKey(id.Secret),
+		PrivateKeySource: PrivateKeySourceFile,
+		PrivateKeyPath:   nodeKeyPath,
+	}
+
+	loaded := &Identity{}
+	if err := loaded.applyConfigJSON(jID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.PrivateKey.Equals(id.PrivateKey) {
+		t.Error("private key loaded from node_key.json file did not match")
+	}
+	if loaded.KeySource.Source != PrivateKeySourceFile || loaded.KeySource.Path != nodeKeyPath {
+		t.Error("KeySource was not recorded on the loaded identity")
+	}
+
+	// Re-saving must not inline the key into the main identity file.
+	raw, err := loaded.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := &identityJSON{}
+	if err := json.Unmarshal(raw, reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.PrivateKey != "" {
+		t.Error("expected re-saved identity to keep the file-sourced key out of private_key")
+	}
+	if reloaded.PrivateKeySource != PrivateKeySourceFile || reloaded.PrivateKeyPath != nodeKeyPath {
+		t.Error("expected re-saved identity to preserve private_key_source and private_key_path")
+	}
+}
+
+func TestRotateResetsFileSourcedIdentityToInline(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+	pkb, err := id.PrivateKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pKey := base64.StdEncoding.EncodeToString(pkb)
+
+	tmpDir, err := ioutil.TempDir("", "identity-rotate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	nodeKeyPath := tmpDir + "/node_key.json"
+	identityPath := tmpDir + "/identity.json"
+
+	if err := ioutil.WriteFile(nodeKeyPath, []byte(`{"private_key":"`+pKey+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jID := &identityJSON{
+		Peername:         "rotatetest",
+		Secret:           EncodeProtectorKey(id.Secret),
+		PrivateKeySource: PrivateKeySourceFile,
+		PrivateKeyPath:   nodeKeyPath,
+	}
+
+	loaded := &Identity{}
+	if err := loaded.applyConfigJSON(jID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	originalID := loaded.ID
+
+	oldID, err := loaded.Rotate(DefaultConfigCrypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldID != originalID {
+		t.Errorf("Rotate returned %s, expected the previous ID %s", oldID, originalID)
+	}
+	if loaded.ID == originalID {
+		t.Error("Rotate did not change the ID")
+	}
+	if loaded.KeySource.Source != "" {
+		t.Errorf("expected Rotate to reset KeySource to inline, got %q", loaded.KeySource.Source)
+	}
+
+	if err := loaded.SaveJSON(identityPath); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(identityPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Identity{}
+	if err := reloaded.LoadJSON(raw); err != nil {
+		t.Fatalf("identity failed to reload after Rotate+SaveJSON: %s", err)
+	}
+	if reloaded.ID != loaded.ID {
+		t.Error("reloaded identity has the wrong ID after rotation")
+	}
+	if !reloaded.PrivateKey.Equals(loaded.PrivateKey) {
+		t.Error("reloaded identity has the wrong private key after rotation")
+	}
+}
+
+func TestEnvKeyProvider(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+	pkb, err := id.PrivateKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CLUSTER_TEST_PRIVATE_KEY", base64.StdEncoding.EncodeToString(pkb))
+	defer os.Unsetenv("CLUSTER_TEST_PRIVATE_KEY")
+
+	jID := &identityJSON{
+		Peername:         "envtest",
+		Secret:           EncodeProtectorKey(id.Secret),
+		PrivateKeySource: PrivateKeySourceEnv,
+		PrivateKeyEnvVar: "CLUSTER_TEST_PRIVATE_KEY",
+	}
+
+	loaded := &Identity{}
+	if err := loaded.applyConfigJSON(jID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.PrivateKey.Equals(id.PrivateKey) {
+		t.Error("private key loaded from env var did not match")
+	}
+}
+
+func TestExecKeyProvider(t *testing.T) {
+	id := testIdentity(t, IdentityOptions{})
+	pkb, err := id.PrivateKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jID := &identityJSON{
+		Peername:         "exectest",
+		Secret:           EncodeProtectorKey(id.Secret),
+		PrivateKeySource: PrivateKeySourceExec,
+		PrivateKeyExec:   "echo " + base64.StdEncoding.EncodeToString(pkb),
+	}
+
+	loaded := &Identity{}
+	if err := loaded.applyConfigJSON(jID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.PrivateKey.Equals(id.PrivateKey) {
+		t.Error("private key loaded from private_key_exec did not match")
+	}
+}